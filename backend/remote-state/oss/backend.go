@@ -1,20 +1,49 @@
 package oss
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/denverdino/aliyungo/common"
 	"github.com/denverdino/aliyungo/location"
+	"github.com/denverdino/aliyungo/sts"
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"log"
 )
 
+// ecsRoleNameMetaDataEndpoint is the ECS metadata service path that returns a
+// temporary AccessKeyId/AccessKeySecret/SecurityToken triple for the RAM
+// role attached to the running instance.
+const ecsRoleNameMetaDataEndpoint = "http://100.100.100.200/latest/meta-data/ram/security-credentials/"
+
+// ecsRoleMetadataTimeout bounds a single request to the ECS metadata
+// service. It's a link-local address only reachable from inside an ECS
+// instance, so a mis-set ecs_role_name (or running this config off-ECS)
+// should fail fast rather than hang terraform init indefinitely.
+const ecsRoleMetadataTimeout = 5 * time.Second
+
+// ecsRoleMetadataMaxAttempts bounds the total number of attempts, the first
+// one included, to reach the metadata service before giving up.
+const ecsRoleMetadataMaxAttempts = 3
+
+// stsTokenExpirationSlop is subtracted from the STS-reported expiration so
+// that we refresh the token a little before it actually expires.
+const stsTokenExpirationSlop = 5 * time.Minute
+
 // New creates a new backend for OSS remote state.
 func New() backend.Backend {
 	s := &schema.Backend{
@@ -53,23 +82,67 @@ func New() backend.Backend {
 				Description: "The name of the OSS bucket",
 			},
 
-			"path": &schema.Schema{
+			"key": &schema.Schema{
 				Type:        schema.TypeString,
 				Required:    true,
 				Description: "The path relative to your object storage directory where the state file will be stored.",
+				ValidateFunc: func(v interface{}, s string) ([]string, []error) {
+					if strings.HasPrefix(v.(string), "/") || strings.HasSuffix(v.(string), "/") {
+						return nil, []error{fmt.Errorf("key can not start and end with '/'")}
+					}
+					return nil, nil
+				},
 			},
 
-			"name": &schema.Schema{
+			"workspace_key_prefix": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
-				Description: "The name of the state file inside the bucket",
+				Description: "The prefix applied to the state path inside the bucket. This is only relevant when using a non-default workspace. Defaults to 'env:'",
+				Default:     "env:",
 				ValidateFunc: func(v interface{}, s string) ([]string, []error) {
-					if strings.HasPrefix(v.(string), "/") || strings.HasSuffix(v.(string), "/") {
-						return nil, []error{fmt.Errorf("name can not start and end with '/'")}
+					prefix := v.(string)
+					if strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+						return nil, []error{fmt.Errorf("workspace_key_prefix can not start and end with '/'")}
 					}
 					return nil, nil
 				},
-				Default: "terraform.tfstate",
+			},
+
+			"ecs_role_name": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The RAM Role Name attached on a ECS instance for API operations. You can retrieve this from the 'Access Control' section of the Alibaba Cloud console.",
+				DefaultFunc: schema.EnvDefaultFunc("ALICLOUD_ECS_ROLE_NAME", ""),
+			},
+
+			"assume_role": &schema.Schema{
+				Type:     schema.TypeSet,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"role_arn": &schema.Schema{
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "The ARN of the role to assume.",
+						},
+						"session_name": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The session name to use when making the AssumeRole call.",
+						},
+						"policy": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "The permissions applied to the temporary security credentials. You cannot grant permissions that exceed those of the role that is being assumed.",
+						},
+						"session_expiration": &schema.Schema{
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "The time after which the established session for assuming role expires.",
+						},
+					},
+				},
 			},
 
 			"lock": &schema.Schema{
@@ -86,6 +159,33 @@ func New() backend.Backend {
 				Default:     false,
 			},
 
+			"sse_algorithm": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The algorithm used to encrypt the state file. Valid values are 'AES256' and 'KMS'. Defaults to 'AES256'",
+				Default:     "AES256",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					value := v.(string)
+					if value != "AES256" && value != "KMS" {
+						return nil, []error{fmt.Errorf("%q must be either %q or %q, got %q", k, "AES256", "KMS", value)}
+					}
+					return nil, nil
+				},
+			},
+
+			"sse_kms_key_id": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The ID of a customer-managed KMS CMK to use for server side encryption. Only used when sse_algorithm is 'KMS'.",
+			},
+
+			"versioning": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Whether to track state history using OSS bucket versioning. The target bucket must already have versioning enabled.",
+				Default:     false,
+			},
+
 			"acl": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -103,6 +203,53 @@ func New() backend.Backend {
 					return nil, nil
 				},
 			},
+
+			"endpoint": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A custom endpoint for the OSS API, bypassing the Location Service lookup. Use this for private OSS endpoints and VPC-internal (oss-<region>-internal.aliyuncs.com) deployments.",
+				DefaultFunc: schema.EnvDefaultFunc("OSS_ENDPOINT", ""),
+			},
+
+			"secure": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Whether to use HTTPS to talk to the OSS endpoint. Defaults to true",
+				Default:     true,
+			},
+
+			"insecure_skip_verify": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Whether to skip TLS certificate verification when secure is true",
+				Default:     false,
+			},
+
+			"proxy_url": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A proxy URL to use for OSS API requests, in place of HTTP_PROXY/HTTPS_PROXY",
+			},
+
+			"max_retries": &schema.Schema{
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The maximum number of times to retry an OSS API request that fails with a 5xx status or a RequestTimeout/InternalError error code. Must be between 0 and 20",
+				Default:     3,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if value := v.(int); value < 0 || value > 20 {
+						return nil, []error{fmt.Errorf("%q must be between 0 and 20, got %d", k, value)}
+					}
+					return nil, nil
+				},
+			},
+
+			"request_timeout": &schema.Schema{
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The per-request timeout, in seconds, for OSS API requests. Defaults to 0 (no timeout)",
+				Default:     0,
+			},
 		},
 	}
 
@@ -118,17 +265,38 @@ type Backend struct {
 	ossClient *oss.Client
 
 	bucketName           string
-	statePath            string
-	stateName            string
+	workspaceKeyPrefix   string
+	keyName              string
 	serverSideEncryption bool
+	sseAlgorithm         string
+	sseKMSKeyId          string
+	versioning           bool
 	acl                  string
 	security_token       string
 	endpoint             string
 	lock                 bool
+
+	// credential refresh bookkeeping, populated when assume_role or
+	// ecs_role_name is used. Per-request token refresh during an
+	// already in-flight operation is handled by refreshingCredentialsProvider
+	// (wired into b.ossClient in configure()); these fields only track the
+	// STS/ECS-issued token's expiration so configure() knows whether it
+	// needs to rebuild the client (e.g. to re-resolve the OSS endpoint) the
+	// next time it's invoked.
+	stsExpiration time.Time
+	ecsRoleName   string
+	assumeRole    *assumeRoleConfig
+}
+
+type assumeRoleConfig struct {
+	roleARN           string
+	sessionName       string
+	policy            string
+	sessionExpiration int
 }
 
 func (b *Backend) configure(ctx context.Context) error {
-	if b.ossClient != nil {
+	if b.ossClient != nil && !b.credentialsNeedRefresh() {
 		return nil
 	}
 
@@ -136,22 +304,36 @@ func (b *Backend) configure(ctx context.Context) error {
 	d := schema.FromContextBackendConfig(ctx)
 
 	b.bucketName = d.Get("bucket").(string)
-	dir := strings.Trim(d.Get("path").(string), "/")
-	if strings.HasPrefix(dir, "./") {
-		dir = strings.TrimPrefix(dir, "./")
-
-	}
-
-	b.statePath = dir
-	b.stateName = d.Get("name").(string)
+	b.keyName = d.Get("key").(string)
+	b.workspaceKeyPrefix = d.Get("workspace_key_prefix").(string)
 	b.serverSideEncryption = d.Get("encrypt").(bool)
+	b.sseAlgorithm = d.Get("sse_algorithm").(string)
+	b.sseKMSKeyId = d.Get("sse_kms_key_id").(string)
+	b.versioning = d.Get("versioning").(bool)
 	b.acl = d.Get("acl").(string)
 	b.lock = d.Get("lock").(bool)
+	b.ecsRoleName = d.Get("ecs_role_name").(string)
+
+	if v, ok := d.GetOk("assume_role"); ok && len(v.(*schema.Set).List()) > 0 {
+		role := v.(*schema.Set).List()[0].(map[string]interface{})
+		b.assumeRole = &assumeRoleConfig{
+			roleARN:           role["role_arn"].(string),
+			sessionName:       role["session_name"].(string),
+			policy:            role["policy"].(string),
+			sessionExpiration: role["session_expiration"].(int),
+		}
+	}
+
+	rawAccessKey := d.Get("access_key").(string)
+	rawSecretKey := d.Get("secret_key").(string)
+	rawSecurityToken := d.Get("security_token").(string)
+
+	access_key, secret_key, security_token, err := b.resolveCredentials(rawAccessKey, rawSecretKey, rawSecurityToken)
+	if err != nil {
+		return err
+	}
 
-	access_key := d.Get("access_key").(string)
-	secret_key := d.Get("secret_key").(string)
-	security_token := d.Get("security_token").(string)
-	endpoint := os.Getenv("OSS_ENDPOINT")
+	endpoint := d.Get("endpoint").(string)
 	if endpoint == "" {
 		region := common.Region(d.Get("region").(string))
 		if end, err := b.getOSSEndpointByRegion(access_key, secret_key, security_token, region); err != nil {
@@ -160,15 +342,44 @@ func (b *Backend) configure(ctx context.Context) error {
 			endpoint = end
 		}
 	}
+	b.endpoint = endpoint
+
+	secure := d.Get("secure").(bool)
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
 
 	log.Printf("[DEBUG] Instantiate OSS client using endpoint: %#v", endpoint)
 	var options []oss.ClientOption
-	if security_token != "" {
+	if b.assumeRole != nil || b.ecsRoleName != "" {
+		// assume_role and ecs_role_name issue short-lived tokens. Wrap them in
+		// a CredentialsProvider that re-resolves once the token it's serving
+		// is past expiration, so a long-running operation can refresh
+		// mid-flight instead of failing once the token configure() last
+		// resolved goes stale.
+		options = append(options, oss.SetCredentialsProvider(&refreshingCredentialsProvider{
+			accessKeyID:     access_key,
+			accessKeySecret: secret_key,
+			securityToken:   security_token,
+			expiration:      b.stsExpiration,
+			refresh: func() (string, string, string, time.Time, error) {
+				ak, sk, token, err := b.resolveCredentials(rawAccessKey, rawSecretKey, rawSecurityToken)
+				return ak, sk, token, b.stsExpiration, err
+			},
+		}))
+	} else if security_token != "" {
 		options = append(options, oss.SecurityToken(security_token))
 	}
 	options = append(options, oss.UserAgent(fmt.Sprintf("HashiCorp-Terraform-v%s", strings.TrimSuffix(terraform.VersionString(), "-dev"))))
 
-	if client, err := oss.New(fmt.Sprintf("http://%s", endpoint), access_key, secret_key, options...); err != nil {
+	httpClient, err := b.buildHTTPClient(d)
+	if err != nil {
+		return err
+	}
+	options = append(options, oss.HTTPClient(httpClient))
+
+	if client, err := oss.New(fmt.Sprintf("%s://%s", scheme, endpoint), access_key, secret_key, options...); err != nil {
 		return err
 	} else {
 		b.ossClient = client
@@ -177,6 +388,134 @@ func (b *Backend) configure(ctx context.Context) error {
 	return nil
 }
 
+// buildHTTPClient assembles the *http.Client used by the OSS SDK, wiring up
+// TLS verification, an explicit proxy (or the HTTP(S)_PROXY environment),
+// a per-request timeout, and exponential backoff with jitter on retryable
+// failures.
+func (b *Backend) buildHTTPClient(d *schema.ResourceData) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL := d.Get("proxy_url").(string); proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url %q: %s", proxyURL, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: d.Get("insecure_skip_verify").(bool),
+		},
+	}
+
+	client := &http.Client{
+		Transport: &retryRoundTripper{
+			next:       transport,
+			maxRetries: d.Get("max_retries").(int),
+		},
+	}
+
+	if timeout := d.Get("request_timeout").(int); timeout > 0 {
+		client.Timeout = time.Duration(timeout) * time.Second
+	}
+
+	return client, nil
+}
+
+// retryRoundTripper wraps a http.RoundTripper with exponential backoff and
+// jitter on 5xx responses and the OSS RequestTimeout/InternalError error
+// codes, so transient failures against private/VPC-internal endpoints or
+// behind a flaky corporate proxy don't fail the whole operation.
+type retryRoundTripper struct {
+	next       http.RoundTripper
+	maxRetries int
+}
+
+func (r *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt <= r.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffWithJitter(attempt))
+		}
+
+		// RoundTrip must not mutate the request it was given, so replay the
+		// body onto a shallow copy instead of reassigning req.Body/
+		// ContentLength in place.
+		attemptReq := new(http.Request)
+		*attemptReq = *req
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+			attemptReq.ContentLength = int64(len(body))
+		}
+
+		resp, err = r.next.RoundTrip(attemptReq)
+		if err != nil || attempt == r.maxRetries {
+			return resp, err
+		}
+
+		retryable, rerr := isRetryableResponse(resp)
+		if rerr != nil || !retryable {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+
+	return resp, err
+}
+
+// isRetryableResponse reports whether resp represents a transient OSS
+// failure worth retrying: a 5xx status can be judged from the status line
+// alone, but OSS reports its RequestTimeout/InternalError error codes inside
+// a 400's XML body, so only the 400 case needs to read (and restore) the
+// body. The success path never buffers the response body.
+func isRetryableResponse(resp *http.Response) (bool, error) {
+	if resp.StatusCode >= 500 {
+		return true, nil
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		return false, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	return bytes.Contains(respBody, []byte("RequestTimeout")) || bytes.Contains(respBody, []byte("InternalError")), nil
+}
+
+// maxBackoffShift caps the exponent backoffWithJitter uses, so the computed
+// base delay can never overflow time.Duration (and practically, caps the
+// base delay at 500ms*2^10 = 512s) regardless of how high attempt climbs.
+const maxBackoffShift = 10
+
+// backoffWithJitter returns an exponential backoff delay for the given
+// attempt number (1-indexed), with up to 50% random jitter to avoid
+// thundering-herd retries.
+func backoffWithJitter(attempt int) time.Duration {
+	shift := uint(attempt - 1)
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	base := time.Duration(1<<shift) * 500 * time.Millisecond
+	jitter := time.Duration(rand.Int63n(int64(base) / 2))
+	return base + jitter
+}
+
 func (b *Backend) getOSSEndpointByRegion(access_key, secret_key, security_token string, region common.Region) (string, error) {
 
 	endpointClient := location.NewClient(access_key, secret_key)
@@ -199,3 +538,188 @@ func (b *Backend) getOSSEndpointByRegion(access_key, secret_key, security_token
 
 	return endpoint, nil
 }
+
+// credentialsNeedRefresh reports whether the temporary credentials obtained
+// from assume_role or ecs_role_name are close enough to expiry that
+// configure() should rebuild the OSS client (e.g. to re-resolve the OSS
+// endpoint) rather than reusing the existing one. Refreshing the token
+// itself during an already in-flight operation is handled separately by
+// refreshingCredentialsProvider.
+func (b *Backend) credentialsNeedRefresh() bool {
+	if b.assumeRole == nil && b.ecsRoleName == "" {
+		return false
+	}
+	return !b.stsExpiration.IsZero() && time.Now().After(b.stsExpiration)
+}
+
+// resolveCredentials turns the statically configured access_key/secret_key
+// (or ecs_role_name / assume_role) into the AccessKeyId/AccessKeySecret/
+// SecurityToken triple that should actually be used to talk to OSS.
+func (b *Backend) resolveCredentials(accessKey, secretKey, securityToken string) (string, string, string, error) {
+	if b.assumeRole != nil {
+		ak, sk, token, expiration, err := b.assumeRoleCredentials(accessKey, secretKey, securityToken)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to assume role %q: %s", b.assumeRole.roleARN, err)
+		}
+		b.stsExpiration = expiration
+		return ak, sk, token, nil
+	}
+
+	if b.ecsRoleName != "" {
+		ak, sk, token, expiration, err := b.ecsRoleCredentials(b.ecsRoleName)
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to get credentials from ECS role %q: %s", b.ecsRoleName, err)
+		}
+		b.stsExpiration = expiration
+		return ak, sk, token, nil
+	}
+
+	return accessKey, secretKey, securityToken, nil
+}
+
+// refreshingCredentialsProvider implements the OSS SDK's CredentialsProvider
+// interface so a single long-running backend operation (e.g. a large apply)
+// can keep working past the lifetime of the STS/ECS token that was current
+// when configure() last ran. The SDK calls GetAccessKeyID/GetAccessKeySecret/
+// GetSecurityToken on every request; refresh is only invoked once the
+// previously issued token is at or past its expiration.
+type refreshingCredentialsProvider struct {
+	refresh func() (accessKeyID, accessKeySecret, securityToken string, expiration time.Time, err error)
+
+	mu              sync.Mutex
+	accessKeyID     string
+	accessKeySecret string
+	securityToken   string
+	expiration      time.Time
+}
+
+func (p *refreshingCredentialsProvider) ensureFresh() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.expiration.IsZero() && time.Now().Before(p.expiration) {
+		return
+	}
+
+	accessKeyID, accessKeySecret, securityToken, expiration, err := p.refresh()
+	if err != nil {
+		// Keep serving the previous credentials rather than blanking them
+		// out: if they've truly expired the next OSS request will surface
+		// an auth error, instead of every request failing just because one
+		// refresh attempt hit a transient error.
+		log.Printf("[WARN] failed to refresh OSS credentials: %s", err)
+		return
+	}
+
+	p.accessKeyID, p.accessKeySecret, p.securityToken, p.expiration =
+		accessKeyID, accessKeySecret, securityToken, expiration
+}
+
+// GetCredentials returns p itself; its getters refresh the token as needed.
+func (p *refreshingCredentialsProvider) GetCredentials() oss.Credentials {
+	return p
+}
+
+func (p *refreshingCredentialsProvider) GetAccessKeyID() string {
+	p.ensureFresh()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accessKeyID
+}
+
+func (p *refreshingCredentialsProvider) GetAccessKeySecret() string {
+	p.ensureFresh()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accessKeySecret
+}
+
+func (p *refreshingCredentialsProvider) GetSecurityToken() string {
+	p.ensureFresh()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.securityToken
+}
+
+// assumeRoleCredentials exchanges the static AK/SK for a temporary
+// AccessKeyId/AccessKeySecret/SecurityToken triple by calling STS AssumeRole.
+func (b *Backend) assumeRoleCredentials(accessKey, secretKey, securityToken string) (string, string, string, time.Time, error) {
+	client := sts.NewClient(accessKey, secretKey)
+
+	sessionName := b.assumeRole.sessionName
+	if sessionName == "" {
+		sessionName = "terraform-oss-backend"
+	}
+
+	request := sts.AssumeRoleRequest{
+		RoleArn:         b.assumeRole.roleARN,
+		RoleSessionName: sessionName,
+		Policy:          b.assumeRole.policy,
+	}
+	if b.assumeRole.sessionExpiration > 0 {
+		request.DurationSeconds = b.assumeRole.sessionExpiration
+	}
+
+	response, err := client.AssumeRole(&request)
+	if err != nil {
+		return "", "", "", time.Time{}, err
+	}
+
+	expiration, err := time.Parse(time.RFC3339, response.Credentials.Expiration)
+	if err != nil {
+		// Be conservative if we can't parse the expiration: refresh next time.
+		expiration = time.Now()
+	}
+
+	return response.Credentials.AccessKeyId, response.Credentials.AccessKeySecret,
+		response.Credentials.SecurityToken, expiration.Add(-stsTokenExpirationSlop), nil
+}
+
+// ecsRoleCredentials fetches the temporary AccessKeyId/AccessKeySecret/
+// SecurityToken triple issued to the given RAM role attached to the ECS
+// instance Terraform is running on, from the instance metadata service.
+func (b *Backend) ecsRoleCredentials(roleName string) (string, string, string, time.Time, error) {
+	client := &http.Client{Timeout: ecsRoleMetadataTimeout}
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; attempt <= ecsRoleMetadataMaxAttempts; attempt++ {
+		resp, err = client.Get(ecsRoleNameMetaDataEndpoint + roleName)
+		if err == nil {
+			break
+		}
+		if attempt < ecsRoleMetadataMaxAttempts {
+			time.Sleep(backoffWithJitter(attempt))
+		}
+	}
+	if err != nil {
+		return "", "", "", time.Time{}, fmt.Errorf("failed to reach ECS metadata service after %d attempts: %s", ecsRoleMetadataMaxAttempts, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", time.Time{}, fmt.Errorf("ECS metadata service returned status %s", resp.Status)
+	}
+
+	var credentials struct {
+		Code            string
+		AccessKeyId     string
+		AccessKeySecret string
+		SecurityToken   string
+		Expiration      string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&credentials); err != nil {
+		return "", "", "", time.Time{}, fmt.Errorf("failed to decode ECS metadata response: %s", err)
+	}
+	if credentials.Code != "" && credentials.Code != "Success" {
+		return "", "", "", time.Time{}, fmt.Errorf("ECS metadata service returned code %q", credentials.Code)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, credentials.Expiration)
+	if err != nil {
+		expiration = time.Now()
+	}
+
+	return credentials.AccessKeyId, credentials.AccessKeySecret, credentials.SecurityToken,
+		expiration.Add(-stsTokenExpirationSlop), nil
+}
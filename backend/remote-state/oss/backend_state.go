@@ -31,6 +31,9 @@ func (b *Backend) remoteClient(name string) (*RemoteClient, error) {
 		statePath:            b.statePath(name),
 		lockPath:             b.lockPath(name),
 		serverSideEncryption: b.serverSideEncryption,
+		sseAlgorithm:         b.sseAlgorithm,
+		sseKMSKeyId:          b.sseKMSKeyId,
+		versioning:           b.versioning,
 		acl:                  b.acl,
 	}
 
@@ -147,24 +150,28 @@ func (b *Backend) DeleteState(name string) error {
 
 // extract the object name from the OSS key
 func (b *Backend) keyEnv(key string) string {
-	// we have 3 parts, the workspace key prefix, the workspace name, and the state key name
-	parts := strings.SplitN(key, "/", 3)
-	if len(parts) < 3 {
+	// workspace_key_prefix may itself contain "/" (e.g. "team/prod"), so
+	// strip it as a literal prefix rather than splitting on "/" and
+	// comparing the first segment, which would never match a multi-segment
+	// prefix.
+	prefix := b.workspaceKeyPrefix + "/"
+	if !strings.HasPrefix(key, prefix) {
 		// no workspace prefix here
 		return ""
 	}
 
-	// shouldn't happen since we listed by prefix
-	if parts[0] != b.workspaceKeyPrefix {
+	// we have 2 parts left, the workspace name and the state key name
+	parts := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+	if len(parts) < 2 {
 		return ""
 	}
 
 	// not our key, so don't include it in our listing
-	if parts[2] != b.keyName {
+	if parts[1] != b.keyName {
 		return ""
 	}
 
-	return parts[1]
+	return parts[0]
 }
 
 func (b *Backend) statePath(name string) string {
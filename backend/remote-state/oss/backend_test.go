@@ -34,8 +34,7 @@ func TestBackendConfig(t *testing.T) {
 	config := map[string]interface{}{
 		"region": "cn-beijing",
 		"bucket": "terraform-backend-oss-test",
-		"path":   "mystate",
-		"name":   "first.tfstate",
+		"key":    "mystate/first.tfstate",
 	}
 
 	b := backend.TestBackendConfig(t, New(), config).(*Backend)
@@ -46,12 +45,12 @@ func TestBackendConfig(t *testing.T) {
 	if b.bucketName != "terraform-backend-oss-test" {
 		t.Fatalf("Incorrect bucketName was provided")
 	}
-	if b.statePath != "mystate" {
-		t.Fatalf("Incorrect state file path was provided")
-	}
-	if b.stateName != "first.tfstate" {
+	if b.keyName != "mystate/first.tfstate" {
 		t.Fatalf("Incorrect keyName was provided")
 	}
+	if b.workspaceKeyPrefix != "env:" {
+		t.Fatalf("Incorrect workspaceKeyPrefix was provided")
+	}
 
 	if b.ossClient.Config.AccessKeyID == "" {
 		t.Fatalf("No Access Key Id was provided")
@@ -66,8 +65,7 @@ func TestBackendConfig_invalidKey(t *testing.T) {
 	cfg := map[string]interface{}{
 		"region": "cn-beijing",
 		"bucket": "terraform-backend-oss-test",
-		"path":   "/leading-slash",
-		"name":   "/test.tfstate",
+		"key":    "/leading-slash/test.tfstate",
 	}
 
 	rawCfg, err := config.NewRawConfig(cfg)
@@ -86,16 +84,16 @@ func TestBackend(t *testing.T) {
 	testACC(t)
 
 	bucketName := fmt.Sprintf("terraform-remote-oss-test-%x", time.Now().Unix())
-	statePath := "multi/level/path/"
+	keyName := "multi/level/path/test.tfstate"
 
 	b1 := backend.TestBackendConfig(t, New(), map[string]interface{}{
 		"bucket": bucketName,
-		"path":   statePath,
+		"key":    keyName,
 	}).(*Backend)
 
 	b2 := backend.TestBackendConfig(t, New(), map[string]interface{}{
 		"bucket": bucketName,
-		"path":   statePath,
+		"key":    keyName,
 	}).(*Backend)
 
 	createOSSBucket(t, b1.ossClient, bucketName)
@@ -3,9 +3,12 @@ package oss
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	multierror "github.com/hashicorp/go-multierror"
@@ -21,11 +24,14 @@ type RemoteClient struct {
 	statePath            string
 	lockPath             string
 	serverSideEncryption bool
+	sseAlgorithm         string
+	sseKMSKeyId          string
 	acl                  string
+	versioning           bool
 }
 
 func (c *RemoteClient) Get() (payload *remote.Payload, err error) {
-	buf, err := c.getObj(c.statePath)
+	buf, etag, err := c.getObj(c.statePath)
 	if err != nil {
 		return nil, err
 	}
@@ -36,18 +42,99 @@ func (c *RemoteClient) Get() (payload *remote.Payload, err error) {
 		return nil, nil
 	}
 
-	var hashChannel = make(chan []byte, 1)
 	sum := md5.Sum(buf.Bytes())
-	hashChannel <- sum[:]
+	if err := c.verifyMD5(sum[:], etag); err != nil {
+		return nil, fmt.Errorf("state %s failed integrity check: %s", c.statePath, err)
+	}
+
 	payload = &remote.Payload{
 		Data: buf.Bytes(),
-		MD5:  <-hashChannel,
+		MD5:  sum[:],
 	}
 	return payload, nil
 }
 
+// GetVersion fetches a specific historical version of the state, as
+// recorded by ListVersions, when the bucket has OSS versioning enabled.
+// It is the primitive a "terraform state pull --version=<id>"-style CLI
+// command would call; no such command exists yet, so this is only
+// reachable from Go code (e.g. a future backend/remote-state command or
+// a provider acceptance test), not from the terraform CLI itself.
+func (c *RemoteClient) GetVersion(versionId string) (*remote.Payload, error) {
+	buf, etag, err := c.getObj(c.statePath, oss.VersionId(versionId))
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil || len(buf.Bytes()) == 0 {
+		return nil, nil
+	}
+
+	sum := md5.Sum(buf.Bytes())
+	if err := c.verifyMD5(sum[:], etag); err != nil {
+		return nil, fmt.Errorf("state %s version %s failed integrity check: %s", c.statePath, versionId, err)
+	}
+
+	return &remote.Payload{
+		Data: buf.Bytes(),
+		MD5:  sum[:],
+	}, nil
+}
+
+// ListVersions returns the versions OSS has recorded for the state object,
+// most recent first, when the bucket has versioning enabled. Like
+// GetVersion, it is not wired to any terraform CLI command yet.
+func (c *RemoteClient) ListVersions() ([]oss.ObjectVersionProperties, error) {
+	bucket, err := c.ossClient.Bucket(c.bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting bucket: %#v", err)
+	}
+
+	result, err := bucket.ListObjectVersions(oss.Prefix(c.statePath))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing versions of %s: %#v", c.statePath, err)
+	}
+
+	var versions []oss.ObjectVersionProperties
+	for _, v := range result.ObjectVersions {
+		if v.Key == c.statePath {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+// verifyMD5 checks a locally computed MD5 sum against an object's ETag.
+// Multipart uploads produce a composite ETag (suffixed with "-<n>") that
+// isn't a plain MD5, and OSS doesn't return a content-MD5 ETag for objects
+// encrypted with SSE-KMS either, so both are skipped rather than treated
+// as mismatches. Plain and SSE-OSS (AES256) objects still get a content-MD5
+// ETag, so those continue to be verified.
+func (c *RemoteClient) verifyMD5(sum []byte, etag string) error {
+	if c.serverSideEncryption && c.sseAlgorithm == "KMS" {
+		return nil
+	}
+
+	etag = strings.Trim(etag, `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+
+	expected := hex.EncodeToString(sum)
+	if !strings.EqualFold(expected, etag) {
+		return fmt.Errorf("checksum mismatch: computed %s, remote ETag %s", expected, etag)
+	}
+	return nil
+}
+
 func (c *RemoteClient) Put(data []byte) error {
-	return c.putObj(c.statePath, data)
+	versionId, err := c.putObj(c.statePath, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %#v", c.statePath, err)
+	}
+	if c.versioning && versionId != "" {
+		log.Printf("Put Object %s created version %s.", c.statePath, versionId)
+	}
+	return nil
 }
 
 func (c *RemoteClient) Delete() error {
@@ -55,11 +142,6 @@ func (c *RemoteClient) Delete() error {
 }
 
 func (c *RemoteClient) Lock(info *state.LockInfo) (string, error) {
-	bucket, err := c.ossClient.Bucket(c.bucketName)
-	if err != nil {
-		return "", fmt.Errorf("Error getting bucket: %#v", err)
-	}
-
 	log.Printf("Lock info:%#v", info)
 
 	infoJson, err := json.Marshal(info)
@@ -75,17 +157,49 @@ func (c *RemoteClient) Lock(info *state.LockInfo) (string, error) {
 		info.ID = lockID
 	}
 	info.Path = c.lockPath
-	if exist, err := bucket.IsObjectExist(info.Path); err != nil {
-		return "", fmt.Errorf("Estimating object %s is exist got an error: %#v", info.Path, err)
-	} else if !exist {
-		if err := c.putObj(info.Path, infoJson); err != nil {
+
+	const maxLockAttempts = 3
+	for attempt := 1; attempt <= maxLockAttempts; attempt++ {
+		// Use a conditional PUT (x-oss-forbid-overwrite) so two concurrent
+		// lock attempts can't both observe "no lock" and both write one; OSS
+		// rejects the loser with FileAlreadyExists instead.
+		_, err := c.putObj(info.Path, infoJson, oss.ForbidOverWrite(true))
+		if err == nil {
+			return info.ID, nil
+		}
+
+		if !isLockAlreadyExistsErr(err) {
 			return "", err
 		}
-	} else if _, err := c.validLock(info.ID); err != nil {
-		return "", err
+
+		lockInfo, infoErr := c.lockInfo()
+		if infoErr != nil {
+			return "", fmt.Errorf("lock %s already exists, but failed to read current lock info: %s", info.Path, infoErr)
+		}
+		if lockInfo == nil {
+			// The competing lock was deleted between our failed conditional
+			// PUT and this read, so there's nothing to report as held.
+			// Retry rather than asserting a lock that no longer exists.
+			continue
+		}
+
+		return "", &state.LockError{
+			Info: lockInfo,
+			Err:  fmt.Errorf("lock %s already held", info.Path),
+		}
 	}
 
-	return info.ID, nil
+	return "", fmt.Errorf("failed to acquire lock %s after %d attempts: the competing lock kept disappearing between conflict detection and read", info.Path, maxLockAttempts)
+}
+
+// isLockAlreadyExistsErr reports whether err is the OSS "FileAlreadyExists"
+// error returned by a conditional PutObject when x-oss-forbid-overwrite
+// rejected the request because the object already exists.
+func isLockAlreadyExistsErr(err error) bool {
+	if ossErr, ok := err.(oss.ServiceError); ok {
+		return ossErr.Code == "FileAlreadyExists"
+	}
+	return strings.Contains(err.Error(), "FileAlreadyExists")
 }
 
 func (c *RemoteClient) Unlock(id string) error {
@@ -104,60 +218,74 @@ func (c *RemoteClient) Unlock(id string) error {
 	return nil
 }
 
-func (c *RemoteClient) putObj(key string, data []byte) error {
+// putObj uploads data to key and returns the x-oss-version-id OSS assigned
+// it, if the versioning option is set and the bucket has versioning enabled
+// (empty otherwise).
+func (c *RemoteClient) putObj(key string, data []byte, extra ...oss.Option) (string, error) {
 	log.Printf("Put Object %s.", key)
 	bucket, err := c.ossClient.Bucket(c.bucketName)
 	if err != nil {
-		return fmt.Errorf("Error getting bucket: %#v", err)
+		return "", fmt.Errorf("Error getting bucket: %#v", err)
 	}
 	body := bytes.NewReader(data)
 
-	var options []oss.Option
+	var respHeader http.Header
+	options := append([]oss.Option{}, extra...)
 	if c.acl != "" {
 		options = append(options, oss.ACL(oss.ACLType(c.acl)))
 	}
 	options = append(options, oss.ContentType("application/json"))
 	if c.serverSideEncryption {
-		options = append(options, oss.ServerSideEncryption("AES256"))
+		if c.sseAlgorithm == "KMS" {
+			options = append(options, oss.ServerSideEncryption("KMS"))
+			if c.sseKMSKeyId != "" {
+				options = append(options, oss.ServerSideEncryptionKeyID(c.sseKMSKeyId))
+			}
+		} else {
+			options = append(options, oss.ServerSideEncryption("AES256"))
+		}
 	}
 	options = append(options, oss.ContentLength(int64(len(data))))
+	if c.versioning {
+		options = append(options, oss.GetResponseHeader(&respHeader))
+	}
 
-	if body != nil {
-		if err := bucket.PutObject(key, body, options...); err != nil {
-			return fmt.Errorf("failed to upload %s: %#v", key, err)
-		}
-		log.Printf("Put Object %s successfully.", key)
-		return nil
+	if err := bucket.PutObject(key, body, options...); err != nil {
+		// Returned as-is (not wrapped) so callers such as Lock can type-assert
+		// on oss.ServiceError to recognize specific OSS error codes.
+		return "", err
 	}
-	return nil
+	log.Printf("Put Object %s successfully.", key)
+	return respHeader.Get("x-oss-version-id"), nil
 }
 
-func (c *RemoteClient) getObj(key string) (*bytes.Buffer, error) {
+func (c *RemoteClient) getObj(key string, extra ...oss.Option) (*bytes.Buffer, string, error) {
 	log.Printf("Get Object %s.", key)
 	bucket, err := c.ossClient.Bucket(c.bucketName)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting bucket: %#v", err)
+		return nil, "", fmt.Errorf("Error getting bucket: %#v", err)
 	}
 
 	if exist, err := bucket.IsObjectExist(key); err != nil {
-		return nil, fmt.Errorf("Estimating object %s is exist got an error: %#v", key, err)
+		return nil, "", fmt.Errorf("Estimating object %s is exist got an error: %#v", key, err)
 	} else if !exist {
-		return nil, nil
+		return nil, "", nil
 	}
 
-	var options []oss.Option
+	var respHeader http.Header
+	options := append([]oss.Option{oss.GetResponseHeader(&respHeader)}, extra...)
 	output, err := bucket.GetObject(key, options...)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting object: %#v", err)
+		return nil, "", fmt.Errorf("Error getting object: %#v", err)
 	}
 
 	//defer output
 	buf := bytes.NewBuffer(nil)
 	if _, err := io.Copy(buf, output); err != nil {
-		return nil, fmt.Errorf("Failed to read remote state: %s", err)
+		return nil, "", fmt.Errorf("Failed to read remote state: %s", err)
 	}
 	log.Printf("Get Object %s successfully.", key)
-	return buf, nil
+	return buf, respHeader.Get("ETag"), nil
 }
 
 func (c *RemoteClient) deleteObj(key string) error {
@@ -200,7 +328,7 @@ func (c *RemoteClient) lockError(err error) *state.LockError {
 // lockInfo reads the lock file, parses its contents and returns the parsed
 // LockInfo struct.
 func (c *RemoteClient) lockInfo() (*state.LockInfo, error) {
-	buf, err := c.getObj(c.lockPath)
+	buf, _, err := c.getObj(c.lockPath)
 	if err != nil {
 		return nil, err
 	}
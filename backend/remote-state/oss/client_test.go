@@ -0,0 +1,190 @@
+package oss
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func TestRemoteClient_verifyMD5(t *testing.T) {
+	data := []byte("hello state")
+	rawSum := md5.Sum(data)
+	sum := rawSum[:]
+	hexSum := hex.EncodeToString(sum)
+
+	cases := []struct {
+		name    string
+		client  *RemoteClient
+		etag    string
+		wantErr bool
+	}{
+		{
+			name:   "plain etag matches",
+			client: &RemoteClient{},
+			etag:   hexSum,
+		},
+		{
+			name:   "quoted etag matches",
+			client: &RemoteClient{},
+			etag:   `"` + hexSum + `"`,
+		},
+		{
+			name:   "uppercase etag matches",
+			client: &RemoteClient{},
+			etag:   strings.ToUpper(hexSum),
+		},
+		{
+			name:   "multipart etag is skipped",
+			client: &RemoteClient{},
+			etag:   hexSum + "-2",
+		},
+		{
+			name:   "empty etag is skipped",
+			client: &RemoteClient{},
+			etag:   "",
+		},
+		{
+			name:    "mismatched etag fails",
+			client:  &RemoteClient{},
+			etag:    strings.Repeat("0", len(hexSum)),
+			wantErr: true,
+		},
+		{
+			name: "sse-kms etag is skipped even if it would mismatch",
+			client: &RemoteClient{
+				serverSideEncryption: true,
+				sseAlgorithm:         "KMS",
+			},
+			etag: strings.Repeat("0", len(hexSum)),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.client.verifyMD5(sum, c.etag)
+			if c.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestIsLockAlreadyExistsErr(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "typed ServiceError with FileAlreadyExists code",
+			err:  oss.ServiceError{Code: "FileAlreadyExists"},
+			want: true,
+		},
+		{
+			name: "typed ServiceError with a different code",
+			err:  oss.ServiceError{Code: "NoSuchKey"},
+			want: false,
+		},
+		{
+			name: "wrapped error whose message still contains the code",
+			err:  fmt.Errorf("failed to upload lock: %#v", oss.ServiceError{Code: "FileAlreadyExists"}),
+			want: true,
+		},
+		{
+			name: "unrelated error",
+			err:  fmt.Errorf("connection refused"),
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isLockAlreadyExistsErr(c.err); got != c.want {
+				t.Fatalf("isLockAlreadyExistsErr() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBackoffWithJitter(t *testing.T) {
+	for attempt := 1; attempt <= 6; attempt++ {
+		base := time.Duration(1<<uint(attempt-1)) * 500 * time.Millisecond
+		maxDelay := base + base/2
+
+		for i := 0; i < 20; i++ {
+			d := backoffWithJitter(attempt)
+			if d < base {
+				t.Fatalf("attempt %d: delay %s below base %s", attempt, d, base)
+			}
+			if d > maxDelay {
+				t.Fatalf("attempt %d: delay %s above max %s", attempt, d, maxDelay)
+			}
+		}
+	}
+}
+
+func TestIsRetryableResponse(t *testing.T) {
+	newResp := func(status int, body string) *http.Response {
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}
+	}
+
+	cases := []struct {
+		name string
+		resp *http.Response
+		want bool
+	}{
+		{
+			name: "5xx is retryable",
+			resp: newResp(http.StatusInternalServerError, ""),
+			want: true,
+		},
+		{
+			name: "503 is retryable",
+			resp: newResp(http.StatusServiceUnavailable, ""),
+			want: true,
+		},
+		{
+			name: "400 with RequestTimeout code is retryable",
+			resp: newResp(http.StatusBadRequest, `<Error><Code>RequestTimeout</Code></Error>`),
+			want: true,
+		},
+		{
+			name: "400 with InternalError code is retryable",
+			resp: newResp(http.StatusBadRequest, `<Error><Code>InternalError</Code></Error>`),
+			want: true,
+		},
+		{
+			name: "plain 400 is not retryable",
+			resp: newResp(http.StatusBadRequest, `<Error><Code>InvalidArgument</Code></Error>`),
+			want: false,
+		},
+		{
+			name: "200 is not retryable",
+			resp: newResp(http.StatusOK, ""),
+			want: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, _ := isRetryableResponse(c.resp)
+			if got != c.want {
+				t.Fatalf("isRetryableResponse() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}